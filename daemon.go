@@ -9,7 +9,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
@@ -20,6 +23,23 @@ import (
 // dies for any reason.
 type ReadyFunc = func(ctx context.Context) error
 
+// Options defines optional daemonization behavior for Daemonize.
+type Options struct {
+	// PIDFile, when non-empty, is written with the background process's pid
+	// once it has called Setsid, and removed when the input context passed
+	// to Daemonize is done. It is not removed on an unclean exit (eg:
+	// SIGKILL or power loss), the same as any other pid file.
+	PIDFile string
+
+	// LockFile, when non-empty, must be exclusively acquired by the
+	// foreground process before it starts the background process, so a
+	// second, concurrent Daemonize call using the same LockFile fails fast
+	// instead of starting a second instance. The lock is held by the
+	// background process -- inherited across the fork -- for as long as it
+	// runs, and is released by the kernel when it exits.
+	LockFile string
+}
+
 // Daemonize starts another instance of the current program (aka foreground
 // process) in the background as a daemon. It must be called in both foreground
 // and background processes. It should be invoked early during the program
@@ -48,25 +68,27 @@ type ReadyFunc = func(ctx context.Context) error
 // processes. When unsuccessful or if the input context expires, Daemonize
 // returns a non-nil error to the foreground process and may kill the child
 // process if it has started.
-func Daemonize(ctx context.Context, envKey, envValue string, check ReadyFunc) (foreground bool, err error) {
+//
+// opts may be nil, in which case no pid file is written and no lock is held.
+func Daemonize(ctx context.Context, envKey, envValue string, check ReadyFunc, opts *Options) (foreground bool, err error) {
 	if len(envKey) == 0 || len(envValue) == 0 {
 		return true, os.ErrInvalid
 	}
 
 	if v := os.Getenv(envKey); len(v) == 0 {
-		if err := daemonizeParent(ctx, envKey, envValue, check); err != nil {
+		if err := daemonizeParent(ctx, envKey, envValue, check, opts); err != nil {
 			return true, err
 		}
 		return true, nil
 	}
 
-	if err := daemonizeChild(envKey); err != nil {
+	if err := daemonizeChild(ctx, envKey, opts); err != nil {
 		return false, err
 	}
 	return false, nil
 }
 
-func daemonizeParent(ctx context.Context, envKey, envValue string, check ReadyFunc) (status error) {
+func daemonizeParent(ctx context.Context, envKey, envValue string, check ReadyFunc, opts *Options) (status error) {
 	binaryPath, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("failed to lookup binary: %w", err)
@@ -78,6 +100,17 @@ func daemonizeParent(ctx context.Context, envKey, envValue string, check ReadyFu
 	}
 	defer file.Close()
 
+	files := []*os.File{file, file, file}
+
+	if opts != nil && opts.LockFile != "" {
+		lockFile, err := acquireLock(opts.LockFile)
+		if err != nil {
+			return err
+		}
+		defer lockFile.Close()
+		files = append(files, lockFile)
+	}
+
 	attr := &os.ProcAttr{
 		Dir: "/",
 		Env: []string{
@@ -86,7 +119,7 @@ func daemonizeParent(ctx context.Context, envKey, envValue string, check ReadyFu
 			fmt.Sprintf("HOME=%s", os.Getenv("HOME")),
 			fmt.Sprintf("%s=%s", envKey, envValue),
 		},
-		Files: []*os.File{file, file, file},
+		Files: files,
 		//Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
 	}
 	proc, err := os.StartProcess(binaryPath, os.Args, attr)
@@ -127,11 +160,106 @@ func daemonizeParent(ctx context.Context, envKey, envValue string, check ReadyFu
 	return nil
 }
 
-func daemonizeChild(envKey string) error {
+func daemonizeChild(ctx context.Context, envKey string, opts *Options) error {
 	if _, err := unix.Setsid(); err != nil {
 		return fmt.Errorf("could not set session id: %w", err)
 	}
 
+	if opts != nil && opts.PIDFile != "" {
+		if err := os.WriteFile(opts.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			return fmt.Errorf("could not write pid file %q: %w", opts.PIDFile, err)
+		}
+		go func() {
+			<-ctx.Done()
+			os.Remove(opts.PIDFile)
+		}()
+	}
+
 	log.SetOutput(io.Discard)
 	return nil
 }
+
+// acquireLock opens (creating if necessary) path and acquires a
+// non-blocking exclusive flock on it, so that a concurrent call targeting
+// the same path fails immediately instead of blocking or silently racing.
+func acquireLock(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %q: %w", path, err)
+	}
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("another instance is already running (lock file %q): %w", path, err)
+	}
+	return file, nil
+}
+
+// ReadPIDFile reads and parses the pid written by a running instance at
+// path, eg: Options.PIDFile.
+func ReadPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid pid file %q: %w", path, err)
+	}
+	return pid, nil
+}
+
+// SignalRunning reads the pid from path -- eg: Options.PIDFile -- and
+// signals that process with sig. It is a convenience for admin CLIs that
+// need to reload or stop a running daemon without separately tracking its
+// pid.
+func SignalRunning(path string, sig os.Signal) error {
+	pid, err := ReadPIDFile(path)
+	if err != nil {
+		return err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(sig)
+}
+
+// listenFdsEnvKey is the systemd socket-activation environment variable
+// naming the number of inherited listening sockets, starting at fd 3.
+const listenFdsEnvKey = "LISTEN_FDS"
+
+// InheritedListeners reconstructs the [net.Listener] values passed down by a
+// parent process -- typically a [monitor.SelfMonitor] performing a graceful
+// restart -- through the LISTEN_FDS environment variable and inherited file
+// descriptors starting at fd 3, mirroring systemd's socket activation
+// protocol.
+//
+// Unlike systemd, the LISTEN_PID check is skipped: the parent process only
+// learns the child's pid after the fork-and-exec syscall that starts it has
+// already completed, so by construction it cannot advertise that pid through
+// the child's own environment. Callers that need stricter isolation should
+// use an application-specific environment variable instead, the same way
+// [Daemonize] and [monitor.SelfMonitor] already do.
+//
+// The returned listeners are independent of LISTEN_FDS, which is cleared so
+// a second call (eg: after a further graceful restart) returns nil.
+func InheritedListeners() ([]net.Listener, error) {
+	n, err := strconv.Atoi(os.Getenv(listenFdsEnvKey))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	os.Unsetenv(listenFdsEnvKey)
+
+	listeners := make([]net.Listener, 0, n)
+	for i := 0; i < n; i++ {
+		fd := 3 + i
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("inherited-listener-%d", i))
+		l, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("could not reconstruct inherited listener for fd %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
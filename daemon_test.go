@@ -0,0 +1,212 @@
+// Copyright (c) 2025 Visvasity LLC
+
+package daemon
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// testRoleEnv selects which re-exec'd role below the test binary plays,
+// standing in for the real monitored child InheritedListeners is written
+// for: a process started with a listener already open on fd 3 and
+// LISTEN_FDS=1 in its environment, exactly as (*exec.Cmd).ExtraFiles and
+// monitor.startChild set it up.
+const testRoleEnv = "DAEMON_TEST_ROLE"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testRoleEnv) == "inherit-listener" {
+		runInheritListenerChild()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runInheritListenerChild reconstructs its inherited listener and reports
+// back over stdout whether LISTEN_FDS was cleared and the listener actually
+// accepted a connection, so the parent test can assert on both without
+// sharing any state besides pipes and exit status.
+func runInheritListenerChild() {
+	listeners, err := InheritedListeners()
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	if len(listeners) != 1 {
+		fmt.Printf("error: got %d listeners, want 1\n", len(listeners))
+		return
+	}
+	defer listeners[0].Close()
+
+	if v := os.Getenv(listenFdsEnvKey); v != "" {
+		fmt.Printf("error: %s = %q after InheritedListeners, want it cleared\n", listenFdsEnvKey, v)
+		return
+	}
+
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	conn.Close()
+	fmt.Println("ok")
+}
+
+// TestAcquireLockExcludesConcurrentInstance exercises the exact scenario
+// LockFile exists for: two processes racing to become the single running
+// instance. Both call acquireLock on the same path at (as close to) the
+// same time; exactly one must win the flock and the other must fail fast
+// rather than block.
+func TestAcquireLockExcludesConcurrentInstance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+
+	start := make(chan struct{})
+	files := make(chan *os.File, 2)
+	errs := make(chan error, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			f, err := acquireLock(path)
+			files <- f
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(files)
+	close(errs)
+
+	// Both winners and losers are collected before any lock is released, so
+	// a winner closing its file (and thereby releasing the flock) can't let
+	// the loser succeed too and mask the race this test exists to catch.
+	var oks, fails int
+	for err := range errs {
+		if err == nil {
+			oks++
+		} else {
+			fails++
+		}
+	}
+	for f := range files {
+		if f != nil {
+			f.Close()
+		}
+	}
+	if oks != 1 || fails != 1 {
+		t.Fatalf("got %d successes and %d failures acquiring the same lock concurrently, want exactly one of each", oks, fails)
+	}
+}
+
+// TestReadPIDFileAndSignalRunning round-trips a real process's pid through
+// ReadPIDFile and SignalRunning, the same way an admin CLI would against a
+// daemon started with Options.PIDFile.
+func TestReadPIDFileAndSignalRunning(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer cmd.Process.Kill()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	if err := os.WriteFile(pidFile, []byte(strconv.Itoa(cmd.Process.Pid)+"\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	pid, err := ReadPIDFile(pidFile)
+	if err != nil {
+		t.Fatalf("ReadPIDFile: %v", err)
+	}
+	if pid != cmd.Process.Pid {
+		t.Fatalf("ReadPIDFile = %d, want %d", pid, cmd.Process.Pid)
+	}
+
+	if err := SignalRunning(pidFile, syscall.SIGTERM); err != nil {
+		t.Fatalf("SignalRunning: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("cmd.Wait returned nil, want the process to have been killed by SIGTERM")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("process did not exit after SignalRunning sent it SIGTERM")
+	}
+}
+
+// TestInheritedListenersReconstructsARealListener confirms InheritedListeners
+// round-trips an actual listening socket through the LISTEN_FDS/fd-3
+// protocol, the same mechanism [monitor.SelfMonitor] uses to hand a
+// replacement child its predecessor's listener during a graceful restart.
+// It re-execs the test binary with the listener passed over
+// (*exec.Cmd).ExtraFiles, the real inheritance path, rather than poking at
+// fd 3 of the test process itself, which the Go test harness also keeps
+// housekeeping fds on.
+func TestInheritedListenersReconstructsARealListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer l.Close()
+
+	lf, ok := l.(*net.TCPListener)
+	if !ok {
+		t.Fatalf("listener is a %T, not *net.TCPListener", l)
+	}
+	file, err := lf.File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	defer file.Close()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), testRoleEnv+"=inherit-listener", fmt.Sprintf("%s=1", listenFdsEnvKey))
+	cmd.ExtraFiles = []*os.File{file}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// The child blocks in Accept until this Dial lands, so it must happen
+	// concurrently with the child running, not after it exits.
+	dialErrc := make(chan error, 1)
+	go func() {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 2*time.Second)
+		if conn != nil {
+			conn.Close()
+		}
+		dialErrc <- err
+	}()
+
+	out, readErr := io.ReadAll(stdout)
+	waitErr := cmd.Wait()
+	if err := <-dialErrc; err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	if readErr != nil {
+		t.Fatalf("reading child output: %v", readErr)
+	}
+	if waitErr != nil {
+		t.Fatalf("child process: %v (output: %q)", waitErr, out)
+	}
+	if got := string(out); got != "ok\n" {
+		t.Fatalf("child process reported %q, want %q", got, "ok\n")
+	}
+}
@@ -25,10 +25,16 @@ func main() {
 
 	daemonizeEnvKey := "DAEMONIZE_ENVKEY"
 	if *background {
-		addrURL, receiver, closer := initstatus.Receiver(ctx)
+		addrURL, receiver, _, closer := initstatus.Receiver(ctx)
 		defer closer()
 
-		foreground, err := daemon.Daemonize(ctx, daemonizeEnvKey, addrURL, receiver)
+		foreground, err := daemon.Daemonize(ctx, daemonizeEnvKey, addrURL, func(ctx context.Context) error {
+			status, err := receiver(ctx)
+			if err == nil && len(status.Metadata) != 0 {
+				log.Printf("background process reported: %v", status.Metadata)
+			}
+			return err
+		}, nil /* Options */)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -6,76 +6,386 @@
 package initstatus
 
 import (
+	"bytes"
 	"context"
-	"errors"
+	"encoding/json"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
-// ReceiveFunc waits for initialization status report.
-type ReceiveFunc = func(context.Context) error
+// Kind identifies the category of an initialization status report.
+type Kind string
 
-// Receiver starts a temporary http server listening at the returned
-// address. This temporary server accepts a single incoming POST request that
-// should contain the initialization status. Returned closer will close the
-// server and reports [os.ErrClosed] to the receiver if no status was reported
+const (
+	// Ready indicates that the child process initialized successfully.
+	Ready Kind = "ready"
+	// Error indicates that the child process failed to initialize.
+	Error Kind = "error"
+)
+
+// Well-known Status.Code values. Receivers are free to define and act on
+// their own codes; an empty or unrecognized Code on a Kind: Error status is
+// treated as a transient failure.
+const (
+	// CodeFatal marks a Kind: Error status as permanent, eg: an invalid
+	// configuration that retrying cannot fix. [monitor.SelfMonitor] treats
+	// an init-time Error status carrying this Code the same as a
+	// NotifyFatal notification: it stops restarting the child instead of
+	// backing off and retrying.
+	CodeFatal = "fatal"
+)
+
+// Status is the structured payload exchanged between a child process and its
+// receiver (the foreground process or a monitor) to report initialization
+// outcome. Besides a human-readable Message, it carries a machine-readable
+// Code and arbitrary Metadata (eg: listen addresses, PID) so receivers can
+// make automated decisions -- such as whether to restart the child -- instead
+// of parsing free-form strings.
+type Status struct {
+	Kind     Kind              `json:"kind"`
+	Code     string            `json:"code,omitempty"`
+	Message  string            `json:"message,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Error implements the error interface, so a failed Status can be returned
+// and compared like any other error.
+func (s *Status) Error() string {
+	if s == nil {
+		return ""
+	}
+	if s.Code != "" {
+		return fmt.Sprintf("%s: %s", s.Code, s.Message)
+	}
+	return s.Message
+}
+
+// ReceiveFunc waits for an initialization status report and returns the
+// structured Status reported by the child, if any.
+type ReceiveFunc = func(context.Context) (*Status, error)
+
+// NotifyKey identifies a well-known sd_notify-style notification sent by
+// Notify. Keys other than the ones predefined here are also accepted and are
+// delivered to the receiver verbatim, mirroring systemd's sd_notify, which
+// tolerates unrecognized keys.
+type NotifyKey string
+
+const (
+	// NotifyReady signals that the process is done initializing. Monitors
+	// that also wait for the initial Status report will normally already know
+	// this, but long-running services that re-initialize (eg: after a
+	// RELOADING) can use it to signal readiness again.
+	NotifyReady NotifyKey = "READY"
+	// NotifyStopping signals that the process has begun a graceful shutdown
+	// and is not going to recover on its own.
+	NotifyStopping NotifyKey = "STOPPING"
+	// NotifyReloading signals that the process is reloading its
+	// configuration and remains otherwise healthy.
+	NotifyReloading NotifyKey = "RELOADING"
+	// NotifyFatal is a visvasity/daemon extension (not present in sd_notify)
+	// signaling that the process has hit a terminal error and must not be
+	// restarted, eg: an invalid configuration.
+	NotifyFatal NotifyKey = "FATAL"
+	// NotifyWatchdog is a liveness ping sent periodically by [Watchdog],
+	// mirroring sd_notify's WATCHDOG=1. It tells the receiver that the
+	// process is alive and not stuck, as opposed to just running.
+	NotifyWatchdog NotifyKey = "WATCHDOG"
+)
+
+// Notification is a single key/value pair reported through Notify, eg:
+// {Key: NotifyReady, Value: "1"}.
+type Notification struct {
+	Key   NotifyKey
+	Value string
+}
+
+// unixScheme identifies an addrURL that must be dialed over a unix domain
+// socket instead of TCP. The socket path is stored percent-encoded
+// immediately after the "scheme://" prefix, eg:
+// "http+unix://%2Frun%2Ffoo%2Finitstatus.sock", with any further path (eg:
+// the "/notify" suffix Notify appends) following as the first literal "/".
+// This is deliberately not parsed with url.Parse: net/url rejects a
+// percent-encoded "/" in a URL's host component as an invalid escape, so a
+// real filesystem path -- which routinely contains "/" -- can never round
+// -trip through url.Parse's host validation once encoded there.
+const unixScheme = "http+unix"
+
+// newSocketListener creates a unix domain socket, readable and writable only
+// by the current user, in dir (or $XDG_RUNTIME_DIR, or os.TempDir when both
+// are empty). It returns a nil listener and empty path on any failure,
+// letting the caller fall back to a TCP listener.
+//
+// The socket lives inside a freshly created, process-private 0700
+// subdirectory of dir rather than directly inside it: net.Listen("unix", _)
+// has no mode argument, so a post-hoc os.Chmod on the socket path would
+// leave a window -- however narrow -- where it exists with whatever
+// permissions the containing directory's default umask gives it, the exact
+// class of exposure this function exists to close. A 0700 directory denies
+// every other local user access to the socket from the moment it's created.
+//
+// The directory and socket names are kept deliberately short: sockaddr_un
+// caps a unix socket path at about 108 bytes, and dir is often already a
+// long-ish $XDG_RUNTIME_DIR or test temp directory, leaving little budget
+// to spend on this function's own naming.
+func newSocketListener(dir string) (net.Listener, string) {
+	if dir == "" {
+		dir = os.Getenv("XDG_RUNTIME_DIR")
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+
+	sockDir, err := os.MkdirTemp(dir, "isock*")
+	if err != nil {
+		return nil, ""
+	}
+	if err := os.Chmod(sockDir, 0o700); err != nil {
+		os.RemoveAll(sockDir)
+		return nil, ""
+	}
+
+	path := filepath.Join(sockDir, "s")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		os.RemoveAll(sockDir)
+		return nil, ""
+	}
+	return l, path
+}
+
+// Receiver is equivalent to ReceiverAt(ctx, ""), ie: it picks the unix
+// socket directory automatically.
+func Receiver(ctx context.Context) (addrURL string, receiver ReceiveFunc, notifyc <-chan Notification, closer func()) {
+	return ReceiverAt(ctx, "")
+}
+
+// ReceiverAt starts a temporary http server listening at the returned
+// address, preferring a unix domain socket created in dir (or
+// $XDG_RUNTIME_DIR when dir is empty, or os.TempDir when both are empty)
+// over a loopback TCP port, so that only the current
+// user -- not every local process -- can reach it. The socket lives inside
+// a private 0700 subdirectory, which is removed (along with the socket)
+// when the receiver is closed. If no socket could be created, ReceiverAt
+// falls back to a TCP server the same way Receiver always used to.
+//
+// The server accepts a single POST request at the root path carrying the
+// JSON-encoded initialization Status, consumed by the returned ReceiveFunc,
+// and any number of POST requests at the "/notify" path carrying
+// JSON-encoded Notifications sent through Notify, delivered on the returned
+// channel for as long as the server is running.
+//
+// The server keeps running -- so late Notify calls such as STOPPING=1 or
+// FATAL=1 are not missed -- until the input context is done or the returned
+// closer is called, at which point the notification channel is also closed.
+// Closer reports [os.ErrClosed] to the receiver if no status was reported
 // yet.
-func Receiver(ctx context.Context) (addrURL string, receiver ReceiveFunc, closer func()) {
-	errReady := errors.New("ready")
+func ReceiverAt(ctx context.Context, dir string) (addrURL string, receiver ReceiveFunc, notifyc <-chan Notification, closer func()) {
 	rctx, rcancel := context.WithCancelCause(ctx)
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	sctx, scancel := context.WithCancelCause(ctx)
+	notifications := make(chan Notification, 16)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/notify", func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		var n Notification
+		if err := json.Unmarshal(data, &n); err != nil {
+			return
+		}
+		select {
+		case notifications <- n:
+		case <-sctx.Done():
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		data, err := io.ReadAll(r.Body)
 		if err != nil {
 			rcancel(err)
 			return
 		}
+		status := &Status{Kind: Ready}
 		if len(data) != 0 {
-			rcancel(errors.New(string(data)))
-			return
+			if err := json.Unmarshal(data, status); err != nil {
+				rcancel(err)
+				return
+			}
 		}
-		rcancel(errReady)
-	}))
+		rcancel(status)
+	})
 
+	server := httptest.NewUnstartedServer(mux)
+	var sockPath string
+	if l, path := newSocketListener(dir); l != nil {
+		server.Listener.Close()
+		server.Listener = l
+		sockPath = path
+	}
+	server.Start()
+
+	addr := server.URL
+	if sockPath != "" {
+		addr = unixScheme + "://" + url.PathEscape(sockPath)
+	}
+
+	var closeOnce sync.Once
+	closeServer := func(cause error) {
+		closeOnce.Do(func() {
+			scancel(cause)
+			server.Close()
+			close(notifications)
+			if sockPath != "" {
+				os.RemoveAll(filepath.Dir(sockPath))
+			}
+		})
+	}
 	go func() {
-		<-rctx.Done()
-		server.Close()
+		<-ctx.Done()
+		closeServer(context.Cause(ctx))
 	}()
 
-	receiver = func(ctx context.Context) error {
-		var err error
+	receiver = func(ctx context.Context) (*Status, error) {
+		var cause error
 		select {
 		case <-ctx.Done():
-			err = context.Cause(ctx)
+			cause = context.Cause(ctx)
 		case <-rctx.Done():
-			err = context.Cause(rctx)
+			cause = context.Cause(rctx)
 		}
-		rcancel(err)
-		if !errors.Is(err, errReady) {
-			return err
+		status, ok := cause.(*Status)
+		if !ok {
+			closeServer(cause)
+			return nil, cause
 		}
-		return nil
+		if status.Kind == Error {
+			return status, status
+		}
+		return status, nil
+	}
+
+	return addr, receiver, notifications, func() {
+		rcancel(os.ErrClosed)
+		closeServer(os.ErrClosed)
+	}
+}
+
+// dialer resolves addrURL into an http.Client capable of reaching it and the
+// URL to actually request with that client, transparently handling both
+// plain TCP addresses and unixScheme addresses returned by Receiver.
+func dialer(addrURL string) (*http.Client, string, error) {
+	rest, ok := strings.CutPrefix(addrURL, unixScheme+"://")
+	if !ok {
+		if _, err := url.Parse(addrURL); err != nil {
+			return nil, "", fmt.Errorf("invalid receiver address %q: %w", addrURL, err)
+		}
+		return http.DefaultClient, addrURL, nil
 	}
 
-	return server.URL, receiver, func() { rcancel(os.ErrClosed) }
+	// rest is the percent-encoded socket path, optionally followed by a
+	// literal "/"-prefixed request path (eg: Notify's "/notify" suffix).
+	// url.Parse is deliberately not used here; see unixScheme's doc comment.
+	encodedPath, reqPath, _ := strings.Cut(rest, "/")
+	sockPath, err := url.PathUnescape(encodedPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid unix socket address %q: %w", addrURL, err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sockPath)
+			},
+		},
+	}
+	return client, "http://unix/" + reqPath, nil
 }
 
-// Report sends initialization status at the given receiver address.
+// Report sends a simple initialization status at the given receiver
+// address. A nil status is reported as a successful Ready status, and a
+// non-nil status is reported as an Error status carrying its message.
 func Report(ctx context.Context, addrURL string, status error) error {
+	if status == nil {
+		return ReportStatus(ctx, addrURL, &Status{Kind: Ready})
+	}
+	return ReportStatus(ctx, addrURL, &Status{Kind: Error, Message: status.Error()})
+}
+
+// ReportStatus sends the given structured initialization status at the
+// given receiver address.
+func ReportStatus(ctx context.Context, addrURL string, status *Status) error {
 	if addrURL == "" {
 		return nil
 	}
-	var r io.Reader
-	if status != nil {
-		r = strings.NewReader(status.Error())
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	client, reqURL, err := dialer(addrURL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Watchdog sends a WATCHDOG=1 notification to the receiver at addrURL once
+// per interval until ctx is done, mirroring systemd's sd_notify watchdog
+// protocol. Pair this with a monitor configured with the same interval --
+// eg: monitor.Options.WatchdogInterval, which allows up to 2*interval
+// between pings -- so hung children whose
+// process is alive but stuck (deadlock, blocked I/O) can be force-restarted.
+func Watchdog(ctx context.Context, addrURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			Notify(ctx, addrURL, NotifyWatchdog, "1")
+		}
+	}
+}
+
+// Notify sends a single sd_notify-style key/value notification, eg:
+// Notify(ctx, addrURL, NotifyReady, "1"), to the receiver at addrURL.
+// Unlike Report/ReportStatus, Notify can be called any number of times over
+// the life of the process; each call is delivered on the channel returned
+// by Receiver.
+func Notify(ctx context.Context, addrURL string, key NotifyKey, value string) error {
+	if addrURL == "" {
+		return nil
+	}
+	data, err := json.Marshal(&Notification{Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+	client, reqURL, err := dialer(addrURL + "/notify")
+	if err != nil {
+		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addrURL, r)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL, bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
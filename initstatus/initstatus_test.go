@@ -0,0 +1,86 @@
+// Copyright (c) 2025 Visvasity LLC
+
+package initstatus
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestReportOverUnixSocket exercises the unix-domain-socket transport that
+// Receiver prefers whenever one can be created: a real socket path, percent
+// -encoded into addrURL, must round-trip through Report and Notify without
+// dialer mistaking it for an invalid URL.
+func TestReportOverUnixSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addrURL, receiver, notifyc, closer := Receiver(ctx)
+	defer closer()
+
+	if !strings.HasPrefix(addrURL, unixScheme+"://") {
+		t.Fatalf("addrURL = %q, want a %s:// address (is $XDG_RUNTIME_DIR/os.TempDir unwritable?)", addrURL, unixScheme)
+	}
+
+	if err := Notify(ctx, addrURL, NotifyWatchdog, "1"); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	select {
+	case n := <-notifyc:
+		if n.Key != NotifyWatchdog {
+			t.Fatalf("notification key = %q, want %q", n.Key, NotifyWatchdog)
+		}
+	default:
+		t.Fatalf("notification was not delivered on notifyc")
+	}
+
+	if err := Report(ctx, addrURL, nil); err != nil {
+		t.Fatalf("Report: %v", err)
+	}
+	status, err := receiver(ctx)
+	if err != nil {
+		t.Fatalf("receiver: %v", err)
+	}
+	if status.Kind != Ready {
+		t.Fatalf("status.Kind = %q, want %q", status.Kind, Ready)
+	}
+}
+
+// TestSocketDirIsPrivateAndCleanedUp confirms the socket never exists
+// outside of a process-private 0700 directory -- so an os.Chmod race can
+// never leave it briefly reachable by other local users -- and that the
+// whole directory, not just the socket file, is removed on close.
+func TestSocketDirIsPrivateAndCleanedUp(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addrURL, _, _, closer := Receiver(ctx)
+
+	rest, ok := strings.CutPrefix(addrURL, unixScheme+"://")
+	if !ok {
+		t.Fatalf("addrURL = %q, want a %s:// address (is $XDG_RUNTIME_DIR/os.TempDir unwritable?)", addrURL, unixScheme)
+	}
+	sockPath, err := url.PathUnescape(rest)
+	if err != nil {
+		t.Fatalf("PathUnescape(%q): %v", rest, err)
+	}
+	sockDir := filepath.Dir(sockPath)
+
+	info, err := os.Stat(sockDir)
+	if err != nil {
+		t.Fatalf("Stat(%q): %v", sockDir, err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o700 {
+		t.Fatalf("socket directory %q has permissions %o, want 0700", sockDir, perm)
+	}
+
+	closer()
+
+	if _, err := os.Stat(sockDir); !os.IsNotExist(err) {
+		t.Fatalf("socket directory %q still exists after closer, err = %v", sockDir, err)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2025 Visvasity LLC
+
+//go:build linux
+
+// Package reaper implements PID-1-style adoption and reaping of orphaned
+// descendant processes for a process that opts into becoming a Linux child
+// subreaper.
+package reaper
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Enable marks the calling process as a child subreaper (prctl(2)'s
+// PR_SET_CHILD_SUBREAPER), so orphaned descendants -- eg: helper processes
+// spawned by a monitored child that exits before they do -- are re-parented
+// to it instead of to PID 1, and are therefore reaped by Reap rather than
+// left as zombies under a foreign process forever.
+func Enable() error {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("could not enable subreaper mode: %w", err)
+	}
+	return nil
+}
+
+// trackedPids holds the pids of children that some other goroutine in this
+// process is waiting on directly (eg: via (*exec.Cmd).Wait), keyed by pid
+// with a reference count. Reap consults it so it never consumes the exit
+// status of a pid someone else is specifically waiting on; see Track.
+var (
+	trackedMu   sync.Mutex
+	trackedPids = map[int]int{}
+)
+
+// Track excludes pid from Reap's sweep until the returned forget func is
+// called, so a caller that runs its own (*exec.Cmd).Wait on pid doesn't
+// race Reap for the same exit status. Without this, wait4(-1) reaps
+// whichever ready child the kernel hands back first -- including a
+// directly-managed child, not just an orphaned descendant -- and once it
+// does, the zombie is gone and the direct waiter gets an error instead of
+// the real exit status.
+//
+// Track is safe to call whether or not Reap is running, and before or after
+// pid exits; forget should be called once the caller's own wait on pid has
+// returned, so the pid can be reused by the OS without colliding with a
+// later Track call.
+func Track(pid int) (forget func()) {
+	trackedMu.Lock()
+	trackedPids[pid]++
+	trackedMu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			trackedMu.Lock()
+			defer trackedMu.Unlock()
+			trackedPids[pid]--
+			if trackedPids[pid] <= 0 {
+				delete(trackedPids, pid)
+			}
+		})
+	}
+}
+
+func isTracked(pid int) bool {
+	trackedMu.Lock()
+	defer trackedMu.Unlock()
+	return trackedPids[pid] > 0
+}
+
+// Reap installs a SIGCHLD handler and reaps every exited descendant --
+// including grandchildren and further descendants re-parented to this
+// process by the kernel after Enable -- until ctx is done. Exit statuses are
+// discarded; Reap exists only to prevent zombies from accumulating under a
+// subreaper, not to report them.
+//
+// wait4(-1) reaps indiscriminately, so without care it would race a
+// concurrent direct (*exec.Cmd).Wait on one of this process's children for
+// the same exit status. Reap avoids this by peeking at each ready pid with
+// WNOWAIT before consuming it: a pid registered via Track is left for its
+// owner to reap itself, and the sweep moves on to look for other ready
+// descendants in the same batch instead of stopping there. This is a
+// best-effort pass, not a guarantee: wait4(-1) gives no control over which
+// ready pid it hands back, so if it keeps handing back the same tracked pid
+// the sweep gives up and waits for the next SIGCHLD, and an orphan that
+// never becomes independently ready again could in principle be left a
+// zombie.
+func Reap(ctx context.Context) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGCHLD)
+	defer signal.Stop(sigc)
+
+	reapAll := func() {
+		skipped := map[int]bool{}
+		for {
+			var status unix.WaitStatus
+			pid, err := unix.Wait4(-1, &status, unix.WNOHANG|unix.WNOWAIT, nil)
+			if pid <= 0 || err != nil {
+				return
+			}
+			if isTracked(pid) {
+				// Leave this pid's status in place for its direct waiter.
+				// SIGCHLD can coalesce when several descendants change
+				// state at once, so don't stop the sweep here: an
+				// untracked orphan readied in the same batch still needs
+				// reaping. If WNOWAIT keeps handing back this same tracked
+				// pid with nothing new reaped in between, every remaining
+				// ready pid belongs to a direct waiter, so stop instead of
+				// spinning.
+				if skipped[pid] {
+					return
+				}
+				skipped[pid] = true
+				continue
+			}
+			if _, err := unix.Wait4(pid, &status, unix.WNOHANG, nil); err != nil {
+				return
+			}
+		}
+	}
+
+	reapAll() // Catch orphans that exited before Reap started watching.
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigc:
+			reapAll()
+		}
+	}
+}
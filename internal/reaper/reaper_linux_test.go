@@ -0,0 +1,185 @@
+// Copyright (c) 2025 Visvasity LLC
+
+//go:build linux
+
+package reaper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// readPPid reads a process's parent pid out of /proc, returning false if the
+// process no longer exists.
+func readPPid(pid int) (ppid int, ok bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if rest, found := strings.CutPrefix(line, "PPid:"); found {
+			ppid, err := strconv.Atoi(strings.TrimSpace(rest))
+			return ppid, err == nil
+		}
+	}
+	return 0, false
+}
+
+// skipUnlessWNOWAITWorks skips the calling test when this kernel's wait4(2)
+// rejects the WNOWAIT flag Reap relies on with EINVAL, since Reap can never
+// successfully sweep anything there.
+func skipUnlessWNOWAITWorks(t *testing.T) {
+	t.Helper()
+	var status unix.WaitStatus
+	_, err := unix.Wait4(-1, &status, unix.WNOHANG|unix.WNOWAIT, nil)
+	if err == unix.EINVAL {
+		t.Skip("this kernel's wait4 doesn't support WNOWAIT; Reap cannot function here")
+	}
+}
+
+// testRoleEnv selects which of the two re-exec'd roles below the test
+// binary plays, the same re-exec mechanism the daemon package itself uses
+// to spawn a monitored child.
+const testRoleEnv = "DAEMON_REAPER_TEST_ROLE"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(testRoleEnv) {
+	case "leaf":
+		// A short-lived process that outlives whichever of the roles below
+		// started it, standing in for an orphaned descendant.
+		time.Sleep(150 * time.Millisecond)
+		os.Exit(0)
+	case "parent":
+		// Starts a "leaf", prints its pid, then exits immediately without
+		// waiting on it -- orphaning the leaf onto the nearest subreaper
+		// ancestor, exactly like a monitored child that spawns a helper
+		// process and exits before it does.
+		cmd := exec.Command(os.Args[0])
+		cmd.Env = append(os.Environ(), testRoleEnv+"=leaf")
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintln(os.Stderr, "start leaf:", err)
+			os.Exit(1)
+		}
+		fmt.Println(cmd.Process.Pid)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestTrackAndForget(t *testing.T) {
+	const pid = 123456 // isTracked never validates that the pid actually exists.
+	if isTracked(pid) {
+		t.Fatalf("pid %d reported tracked before Track was ever called", pid)
+	}
+	forget := Track(pid)
+	if !isTracked(pid) {
+		t.Fatalf("pid %d not reported tracked right after Track", pid)
+	}
+	forget()
+	if isTracked(pid) {
+		t.Fatalf("pid %d still reported tracked after forget", pid)
+	}
+}
+
+// TestReapDoesNotStealAnExitStatusFromATrackedWaiter exercises the exact
+// race Track exists to prevent: Reap's wait4(-1) sweep running concurrently
+// with a direct (*exec.Cmd).Wait on the same pid.
+func TestReapDoesNotStealAnExitStatusFromATrackedWaiter(t *testing.T) {
+	skipUnlessWNOWAITWorks(t)
+
+	if err := Enable(); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Reap(ctx)
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), testRoleEnv+"=leaf")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	forget := Track(cmd.Process.Pid)
+	defer forget()
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("cmd.Wait: %v (likely lost the exit status to a concurrent Reap sweep)", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("cmd.Wait did not return; the child may have been reaped out from under it")
+	}
+}
+
+// TestReapAdoptsAndReapsOrphanedGrandchild confirms Reap actually cleans up
+// a grandchild re-parented to this process after Enable, rather than
+// leaving it a permanent zombie.
+func TestReapAdoptsAndReapsOrphanedGrandchild(t *testing.T) {
+	skipUnlessWNOWAITWorks(t)
+
+	if err := Enable(); err != nil {
+		t.Fatalf("Enable: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Reap(ctx)
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), testRoleEnv+"=parent")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("parent process: %v", err)
+	}
+
+	leafPID, err := strconv.Atoi(strings.TrimSpace(out.String()))
+	if err != nil {
+		t.Fatalf("could not parse leaf pid from parent output %q: %v", out.String(), err)
+	}
+
+	// The leaf outlives its immediate parent, which has already exited
+	// above, and should be re-parented to this subreaper process. Some
+	// sandboxed kernels (eg: gVisor) accept PR_SET_CHILD_SUBREAPER but
+	// don't actually implement the reparenting, so skip rather than fail
+	// if that never happens here -- this test is about Reap's behavior
+	// once adoption occurs, not about the kernel's subreaper support.
+	reparented := false
+	for deadline := time.Now().Add(1 * time.Second); time.Now().Before(deadline); {
+		if ppid, ok := readPPid(leafPID); ok && ppid == os.Getpid() {
+			reparented = true
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !reparented {
+		t.Skip("orphaned descendant was never re-parented to this process; kernel may not implement PR_SET_CHILD_SUBREAPER")
+	}
+
+	// Once it exits on its own, Reap must consume its exit status, or
+	// /proc/<pid> lingers forever as a zombie.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", leafPID)); os.IsNotExist(err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("orphaned leaf pid %d was never reaped", leafPID)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright (c) 2025 Visvasity LLC
+
+//go:build !linux
+
+// Package reaper implements PID-1-style adoption and reaping of orphaned
+// descendant processes for a process that opts into becoming a Linux child
+// subreaper. Subreaper mode is Linux-specific (prctl's
+// PR_SET_CHILD_SUBREAPER); on other platforms, Enable reports an error.
+package reaper
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnsupported is returned by Enable on platforms other than Linux.
+var ErrUnsupported = errors.New("subreaper mode is only supported on linux")
+
+// Enable always fails on this platform; see ErrUnsupported.
+func Enable() error {
+	return ErrUnsupported
+}
+
+// Reap returns immediately on this platform, since Enable never succeeds
+// and there is therefore nothing to reap.
+func Reap(ctx context.Context) {}
+
+// Track is a no-op on this platform, since Reap never runs here. The
+// returned forget func is likewise a no-op.
+func Track(pid int) (forget func()) { return func() {} }
@@ -5,23 +5,69 @@ package monitor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"slices"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/visvasity/daemon/initstatus"
+	"github.com/visvasity/daemon/internal/reaper"
 )
 
+// errFatal is the childCtx cancellation cause used when the child reports a
+// FATAL=1 notification, so SelfMonitor can tell it apart from an ordinary
+// exit or shutdown signal.
+var errFatal = errors.New("child reported a fatal status, not restarting")
+
 // Options defines the user configurable values for the Monitor.
 type Options struct {
 	ShutdownSignal    os.Signal     // Defaults to os.Interrupt
 	ShutdownTimeout   time.Duration // Defaults to 10 seconds.
 	MinBackoffTimeout time.Duration // Defaults to one second.
 	MaxBackoffTimeout time.Duration // Defaults to one minute.
+
+	// WatchdogInterval, when non-zero, requires the child to call
+	// [initstatus.Watchdog] with a matching interval after it reports
+	// successful initialization. If no liveness ping is received within
+	// 2*WatchdogInterval, the child is presumed hung and is shut down the
+	// same way as on context expiry -- ShutdownSignal, then SIGKILL after
+	// ShutdownTimeout -- and the attempt is counted as a failure subject to
+	// the usual backoff. Zero disables the watchdog.
+	WatchdogInterval time.Duration
+
+	// GracefulRestartSignal is the signal that triggers a zero-downtime
+	// restart of the monitored child: a replacement child is started first,
+	// and only once it reports successful initialization is the existing
+	// child sent ShutdownSignal and retired. A replacement that fails to
+	// initialize is discarded and the existing child keeps running
+	// undisturbed. Defaults to [syscall.SIGHUP].
+	GracefulRestartSignal os.Signal
+
+	// Listeners, when non-empty, are inherited by every spawned child,
+	// including the very first one, over (*exec.Cmd).ExtraFiles and the
+	// LISTEN_FDS environment variable -- see [daemon.InheritedListeners].
+	// This is what makes GracefulRestartSignal a zero-downtime restart
+	// rather than a connection-dropping one: the same listening sockets
+	// carry over to the replacement child. The monitor retains ownership;
+	// callers must not close them.
+	Listeners []net.Listener
+
+	// Subreaper, when true, marks the monitor process as a Linux child
+	// subreaper (prctl's PR_SET_CHILD_SUBREAPER) and reaps any orphaned
+	// descendants of the monitored child -- eg: helper processes the child
+	// spawned and left behind when it exited -- so they don't become
+	// zombies under whatever process they got re-parented to otherwise.
+	// This does not change how the monitor waits on the child itself,
+	// which is unaffected. On non-Linux platforms, SelfMonitor returns an
+	// error when Subreaper is set.
+	Subreaper bool
 }
 
 func (v *Options) setDefaults() {
@@ -37,6 +83,9 @@ func (v *Options) setDefaults() {
 	if v.MaxBackoffTimeout == 0 {
 		v.MaxBackoffTimeout = time.Minute
 	}
+	if v.GracefulRestartSignal == nil {
+		v.GracefulRestartSignal = syscall.SIGHUP
+	}
 }
 
 func (v *Options) check() error {
@@ -46,11 +95,140 @@ func (v *Options) check() error {
 	return nil
 }
 
+// listenerFiles duplicates the fds behind ls, in the same order, for
+// inheritance by a child process through (*exec.Cmd).ExtraFiles. The
+// returned files are independent of ls; the caller must close them once the
+// child has started.
+func listenerFiles(ls []net.Listener) ([]*os.File, error) {
+	type filer interface {
+		File() (*os.File, error)
+	}
+	files := make([]*os.File, 0, len(ls))
+	for i, l := range ls {
+		f, ok := l.(filer)
+		if !ok {
+			return nil, fmt.Errorf("listener %d (%T) cannot be passed to a child process", i, l)
+		}
+		file, err := f.File()
+		if err != nil {
+			return nil, fmt.Errorf("could not dup listener %d: %w", i, err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// child holds the state of a single spawned and running instance of the
+// monitored program.
+type child struct {
+	cmd     *exec.Cmd
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	exitc   chan error
+	notifyc <-chan initstatus.Notification
+	closer  func()
+}
+
+// startChild spawns a new instance of childArgs and blocks until it either
+// reports its initialization status or dies/fails to report one. The
+// returned *child is non-nil whenever the process was successfully started,
+// even when err is non-nil, so the caller can tear it down.
+func startChild(ctx context.Context, envKey string, childArgs []string, opts *Options, wg *sync.WaitGroup) (*child, *initstatus.Status, error) {
+	childCtx, childCancel := context.WithCancelCause(ctx)
+	addrURL, receiver, notifyc, closer := initstatus.Receiver(ctx)
+
+	cmd := exec.CommandContext(childCtx, childArgs[0], childArgs[1:]...)
+	cmd.Env = append(slices.Clone(os.Environ()), fmt.Sprintf("%s=%s", envKey, addrURL))
+	cmd.WaitDelay = opts.ShutdownTimeout
+	cmd.Cancel = func() error { return cmd.Process.Signal(opts.ShutdownSignal) }
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	var listenerFds []*os.File
+	if len(opts.Listeners) != 0 {
+		files, err := listenerFiles(opts.Listeners)
+		if err != nil {
+			childCancel(nil)
+			closer()
+			return nil, nil, fmt.Errorf("could not prepare inherited listeners: %w", err)
+		}
+		listenerFds = files
+		cmd.ExtraFiles = files
+		cmd.Env = append(cmd.Env, fmt.Sprintf("LISTEN_FDS=%d", len(files)))
+	}
+
+	if err := cmd.Start(); err != nil {
+		for _, f := range listenerFds {
+			f.Close()
+		}
+		childCancel(nil)
+		closer()
+		return nil, nil, fmt.Errorf("could not start child process: %w", err)
+	}
+
+	var untrack func()
+	if opts.Subreaper {
+		// Keep reaper.Reap's wait4(-1) sweep from racing cmd.Wait below for
+		// this child's own exit status; see reaper.Track. This happens
+		// immediately after Start succeeds, before any other work, to keep
+		// the window in which a concurrent Reap sweep could observe the pid
+		// before it's tracked as short as possible.
+		untrack = reaper.Track(cmd.Process.Pid)
+	}
+
+	// The child has its own dup of these fds now; our copies only pin down
+	// the descriptor numbers until Start returns.
+	for _, f := range listenerFds {
+		f.Close()
+	}
+
+	c := &child{ctx: childCtx, cancel: childCancel, cmd: cmd, exitc: make(chan error, 1), notifyc: notifyc, closer: closer}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		err := cmd.Wait()
+		if untrack != nil {
+			untrack()
+		}
+		if err != nil {
+			log.Printf("child has died with status: %v", err)
+		}
+		c.exitc <- err
+		childCancel(err)
+	}()
+
+	status, err := receiver(childCtx)
+	return c, status, err
+}
+
 // SelfMonitor creates another instance of the current program and watches it
 // to auto-restart on failures till the input context is expired. When the
 // input context is expired, existing child process will be signaled to
 // shutdown and the function returns a non-nil error.
 //
+// The child can also tell SelfMonitor to stop restarting it by sending
+// sd_notify-style notifications through [initstatus.Notify]: a `FATAL=1`
+// notification ends the monitor immediately, and a `STOPPING=1` notification
+// followed by a clean (exit code zero) exit is treated as an intentional,
+// permanent shutdown. Any other exit, including one following a `STOPPING=1`
+// that the process failed to complete cleanly, is still treated as a
+// transient failure and is retried with the usual backoff.
+//
+// The same do-not-restart decision also applies if the child never reports
+// success at all: a [initstatus.Status] reported with Kind: Error and a Code
+// of [initstatus.CodeFatal] is treated exactly like a FATAL=1 notification,
+// letting a child that detects an unrecoverable problem during init (eg: an
+// invalid configuration) say so without first having to report Ready.
+//
+// Sending the monitor process Options.GracefulRestartSignal (SIGHUP by
+// default) triggers a zero-downtime restart instead; see the
+// GracefulRestartSignal and Listeners fields for details.
+//
+// Options.Subreaper opts the monitor into adopting and reaping orphaned
+// descendants of the monitored child, not just the child itself; see its
+// doc comment for details.
+//
 // The input `envKey` must be an application-specific, unique non-empty
 // environment variable name, which is used internally to distinguish between
 // the monitor instance and the monitored instance. A temporary http server URL
@@ -73,6 +251,17 @@ func SelfMonitor(ctx context.Context, envKey string, opts *Options) error {
 		return nil // Child process.
 	}
 
+	if opts.Subreaper {
+		if err := reaper.Enable(); err != nil {
+			return fmt.Errorf("could not enable subreaper mode: %w", err)
+		}
+		go reaper.Reap(ctx)
+	}
+
+	restartc := make(chan os.Signal, 1)
+	signal.Notify(restartc, opts.GracefulRestartSignal)
+	defer signal.Stop(restartc)
+
 	var wg sync.WaitGroup
 	defer wg.Wait()
 
@@ -85,34 +274,18 @@ func SelfMonitor(ctx context.Context, envKey string, opts *Options) error {
 		childArgs := slices.Clone(os.Args)
 		childArgs[0] = binPath
 
-		func() {
-			childCtx, childCancel := context.WithCancelCause(ctx)
-			defer childCancel(nil)
-
-			addrURL, receiver, closer := initstatus.Receiver(ctx)
-			defer closer()
-
-			childEnvItem := fmt.Sprintf("%s=%s", envKey, addrURL)
-
-			cmd := exec.CommandContext(childCtx, childArgs[0], childArgs[1:]...)
-			cmd.Env = append(slices.Clone(os.Environ()), childEnvItem)
-			cmd.WaitDelay = opts.ShutdownTimeout
-			cmd.Cancel = func() error { return cmd.Process.Signal(opts.ShutdownSignal) }
-			cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-
-				if err := cmd.Run(); err != nil {
-					log.Printf("child has died with status: %v", err)
-					childCancel(err)
+		permanent := func() bool {
+			h, status, err := startChild(ctx, envKey, childArgs, opts, &wg)
+			if err != nil {
+				if h != nil {
+					h.cancel(err)
+					h.closer()
 				}
-				childCancel(nil)
-			}()
 
-			if err := receiver(childCtx); err != nil {
-				childCancel(err)
+				if s, ok := err.(*initstatus.Status); ok && s.Code == initstatus.CodeFatal {
+					log.Printf("child reported a fatal init status, not restarting: %v", s)
+					return true
+				}
 
 				timeout := min(opts.MinBackoffTimeout<<time.Duration(i), opts.MaxBackoffTimeout)
 				log.Printf("waiting for %v before attempting to restart the child: %v", timeout, childArgs)
@@ -121,17 +294,211 @@ func SelfMonitor(ctx context.Context, envKey string, opts *Options) error {
 				case <-ctx.Done():
 				case <-time.After(timeout):
 				}
-				return
+				return false
 			}
 
+			defer func() { h.closer() }()
+
+			// A missed watchdog deadline below counts as a failed attempt, so
+			// it restores the backoff counter this successful init resets.
+			attempt := i
+
 			// Reset the backoff counter.
 			i = 0
-			log.Printf("child is initialized successfully")
-			select {
-			case <-ctx.Done():
-			case <-childCtx.Done():
+			if len(status.Metadata) != 0 {
+				log.Printf("child is initialized successfully: %v", status.Metadata)
+			} else {
+				log.Printf("child is initialized successfully")
+			}
+
+			var watchdogc <-chan time.Time
+			var resetWatchdog func()
+			setupWatchdog := func() {
+				watchdogc, resetWatchdog = nil, nil
+				if opts.WatchdogInterval <= 0 {
+					return
+				}
+				t := time.NewTimer(2 * opts.WatchdogInterval)
+				watchdogc = t.C
+				resetWatchdog = func() {
+					if !t.Stop() {
+						select {
+						case <-t.C:
+						default:
+						}
+					}
+					t.Reset(2 * opts.WatchdogInterval)
+				}
+			}
+			setupWatchdog()
+
+			stopping := false
+			watchdogMissed := false
+			handleNotification := func(n initstatus.Notification) {
+				switch n.Key {
+				case initstatus.NotifyFatal:
+					log.Printf("child reported a fatal status, not restarting")
+					h.cancel(errFatal)
+				case initstatus.NotifyStopping:
+					stopping = true
+				case initstatus.NotifyWatchdog:
+					if resetWatchdog != nil {
+						resetWatchdog()
+					}
+				}
 			}
+
+			// drainNotifications picks up any notification already buffered
+			// on h.notifyc without blocking. [initstatus.Notify]'s HTTP call
+			// only returns once the notification is queued on that channel,
+			// so a STOPPING=1 immediately followed by the child exiting can
+			// have both h.ctx.Done() and h.notifyc ready in the same
+			// instant; without this, select's random tie-breaking below
+			// would drop the STOPPING roughly half the time and misreport a
+			// clean, intentional shutdown as one to restart from.
+			drainNotifications := func() {
+				for {
+					select {
+					case n, ok := <-h.notifyc:
+						if !ok {
+							return
+						}
+						handleNotification(n)
+					default:
+						return
+					}
+				}
+			}
+
+			// Starting a replacement child blocks on it reporting its
+			// initialization status, which can take arbitrarily long -- or
+			// never happen, if the replacement hangs. Running it in its own
+			// goroutine keeps the wait loop servicing the existing child
+			// (watchdog deadlines, FATAL/STOPPING notifications, further
+			// signals) instead of stalling on an unbounded wait for the
+			// replacement.
+			type restartResult struct {
+				h   *child
+				err error
+			}
+			restartResultc := make(chan restartResult, 1)
+			restartPending := false
+
+			// ctxDone records whether the wait loop ended because the outer
+			// ctx was done, as opposed to h.ctx (derived from ctx, so the
+			// two race on outer shutdown): only h.ctx.Done() corresponds to
+			// the managed child itself actually exiting or being retired,
+			// which is what the stopping/errFatal checks below are about.
+			ctxDone := false
+
+		wait:
+			for {
+				select {
+				case <-ctx.Done():
+					ctxDone = true
+					drainNotifications()
+					break wait
+				case <-h.ctx.Done():
+					drainNotifications()
+					break wait
+				case <-watchdogc:
+					log.Printf("child missed its watchdog deadline, forcing a restart")
+					watchdogMissed = true
+					h.cancel(fmt.Errorf("child missed its watchdog deadline"))
+				case sig := <-restartc:
+					if restartPending {
+						log.Printf("received %v, but a graceful restart is already in progress, ignoring", sig)
+						continue
+					}
+					log.Printf("received %v, starting a replacement child for a graceful restart", sig)
+					restartPending = true
+					go func() {
+						nh, _, nerr := startChild(ctx, envKey, childArgs, opts, &wg)
+						restartResultc <- restartResult{h: nh, err: nerr}
+					}()
+				case res := <-restartResultc:
+					restartPending = false
+					if res.err != nil {
+						log.Printf("replacement child failed to initialize, keeping the existing child running: %v", res.err)
+						if res.h != nil {
+							res.h.cancel(res.err)
+							res.h.closer()
+						}
+						continue
+					}
+					log.Printf("replacement child is initialized successfully, retiring the old one")
+					old := h
+					h = res.h
+					old.cancel(fmt.Errorf("retired by graceful restart"))
+					// Close the retired child's receiver once it has actually
+					// exited, rather than batching it with the active
+					// child's closer in the permanent() defer above -- which
+					// for a long-lived service doing many graceful restarts
+					// may not run for the remaining lifetime of the process,
+					// leaking a unix socket file and HTTP server per
+					// restart.
+					go func(old *child) {
+						<-old.exitc
+						old.closer()
+					}(old)
+					setupWatchdog()
+				case n, ok := <-h.notifyc:
+					if !ok {
+						break wait
+					}
+					handleNotification(n)
+				}
+			}
+
+			if restartPending {
+				// A replacement was still starting up when the loop above
+				// exited for some other reason; it belongs to the state
+				// we're discarding, so tear it down once it reports in
+				// rather than leaking it. This runs detached so it can't
+				// reintroduce the same unbounded wait we just avoided.
+				go func() {
+					res := <-restartResultc
+					if res.h != nil {
+						res.h.cancel(fmt.Errorf("monitor is no longer accepting a graceful restart"))
+						res.h.closer()
+					}
+				}()
+			}
+
+			if ctxDone {
+				// The outer context is what ended the wait loop, not the
+				// managed child; let the caller's context.Cause(ctx) surface
+				// as the real reason instead of a stopping/errFatal verdict
+				// that raced it and may not even reflect the child's actual
+				// state yet.
+				return false
+			}
+
+			if errors.Is(context.Cause(h.ctx), errFatal) {
+				return true
+			}
+			if stopping {
+				// The exit goroutine always pushes onto h.exitc before it
+				// cancels h.ctx, so by the time h.ctx.Done() fires here --
+				// for the actual exit this is meant to observe -- exitc is
+				// already populated and this does not block in practice.
+				return <-h.exitc == nil
+			}
+			if watchdogMissed {
+				i = attempt
+				timeout := min(opts.MinBackoffTimeout<<time.Duration(i), opts.MaxBackoffTimeout)
+				log.Printf("waiting for %v before attempting to restart the child: %v", timeout, childArgs)
+				select {
+				case <-ctx.Done():
+				case <-time.After(timeout):
+				}
+			}
+			return false
 		}()
+
+		if permanent {
+			return fmt.Errorf("child signaled a permanent shutdown, not restarting")
+		}
 	}
 	return context.Cause(ctx)
 }
@@ -0,0 +1,312 @@
+// Copyright (c) 2025 Visvasity LLC
+
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/visvasity/daemon/initstatus"
+)
+
+// These tests exercise SelfMonitor's concurrent state machine end to end,
+// against a real child process rather than a mock: the test binary re-execs
+// itself (the same mechanism startChild uses against the real program under
+// monitoring), and TestMain dispatches to runTestChild whenever
+// testScenarioEnv is set in the process environment, standing in for the
+// monitored program. The scenario to play, and any data it must report
+// back, travel through the same environment-variable channel SelfMonitor
+// itself uses to pass the initstatus receiver address.
+const (
+	testEnvKey      = "DAEMON_MONITOR_TEST_ADDR"
+	testScenarioEnv = "DAEMON_MONITOR_TEST_SCENARIO"
+	testPidFileEnv  = "DAEMON_MONITOR_TEST_PIDFILE"
+)
+
+func TestMain(m *testing.M) {
+	if scenario := os.Getenv(testScenarioEnv); scenario != "" {
+		runTestChild(scenario)
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runTestChild plays one of a handful of scripted child behaviors, then
+// returns once the scenario is done (letting TestMain exit the process).
+func runTestChild(scenario string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	addrURL := os.Getenv(testEnvKey)
+
+	if pidFile := os.Getenv(testPidFileEnv); pidFile != "" {
+		if f, err := os.OpenFile(pidFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600); err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+		}
+	}
+
+	switch scenario {
+	case "ready":
+		// Reports ready and otherwise just runs until signaled.
+		initstatus.Report(ctx, addrURL, nil)
+		<-ctx.Done()
+	case "fatal":
+		initstatus.Report(ctx, addrURL, nil)
+		initstatus.Notify(ctx, addrURL, initstatus.NotifyFatal, "1")
+		<-ctx.Done()
+	case "fatal-code":
+		// Fails to initialize with a structured Error status carrying
+		// CodeFatal, without ever reporting Ready.
+		initstatus.ReportStatus(ctx, addrURL, &initstatus.Status{
+			Kind:    initstatus.Error,
+			Code:    initstatus.CodeFatal,
+			Message: "invalid configuration",
+		})
+	case "stopping":
+		// Voluntarily reports an intentional shutdown and exits cleanly,
+		// without waiting to be signaled.
+		initstatus.Report(ctx, addrURL, nil)
+		time.Sleep(20 * time.Millisecond)
+		initstatus.Notify(context.Background(), addrURL, initstatus.NotifyStopping, "1")
+	case "hang":
+		// Reports ready but never pings the watchdog.
+		initstatus.Report(ctx, addrURL, nil)
+		<-ctx.Done()
+	case "watchdog":
+		initstatus.Report(ctx, addrURL, nil)
+		initstatus.Watchdog(ctx, addrURL, 20*time.Millisecond)
+		<-ctx.Done()
+	}
+}
+
+func TestFatalNotificationStopsMonitorPermanently(t *testing.T) {
+	os.Setenv(testScenarioEnv, "fatal")
+	defer os.Unsetenv(testScenarioEnv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- SelfMonitor(ctx, testEnvKey, &Options{
+			MinBackoffTimeout: 10 * time.Millisecond,
+			MaxBackoffTimeout: 10 * time.Millisecond,
+			ShutdownTimeout:   time.Second,
+		})
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("SelfMonitor returned nil, want a permanent-shutdown error after the child reported FATAL")
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("SelfMonitor did not stop after the child reported FATAL")
+	}
+}
+
+func TestFatalInitStatusCodeStopsMonitorPermanently(t *testing.T) {
+	os.Setenv(testScenarioEnv, "fatal-code")
+	defer os.Unsetenv(testScenarioEnv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- SelfMonitor(ctx, testEnvKey, &Options{
+			// A large backoff would make the test time out if CodeFatal were
+			// not wired up and SelfMonitor fell back to retrying instead.
+			MinBackoffTimeout: time.Minute,
+			MaxBackoffTimeout: time.Minute,
+			ShutdownTimeout:   time.Second,
+		})
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("SelfMonitor returned nil, want a permanent-shutdown error after the child reported a CodeFatal init status")
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("SelfMonitor did not stop after the child reported a CodeFatal init status; did it fall back to backing off and retrying?")
+	}
+}
+
+func TestStoppingNotificationWithCleanExitStopsMonitorPermanently(t *testing.T) {
+	os.Setenv(testScenarioEnv, "stopping")
+	defer os.Unsetenv(testScenarioEnv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- SelfMonitor(ctx, testEnvKey, &Options{
+			MinBackoffTimeout: 10 * time.Millisecond,
+			MaxBackoffTimeout: 10 * time.Millisecond,
+			ShutdownTimeout:   time.Second,
+		})
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("SelfMonitor returned nil, want a permanent-shutdown error after STOPPING=1 and a clean exit")
+		}
+	case <-time.After(4 * time.Second):
+		t.Fatalf("SelfMonitor did not stop after the child reported STOPPING and exited cleanly")
+	}
+}
+
+// runSelfMonitor starts SelfMonitor in the background and registers a
+// cleanup that cancels ctx and waits for it to fully return -- including its
+// own wg.Wait() on every child process it ever spawned -- before the test
+// ends. Without this, a SelfMonitor from one test could still be listening
+// for GracefulRestartSignal (a real, process-wide OS signal) when the next
+// test starts, racing it for the same signal deliveries.
+func runSelfMonitor(t *testing.T, ctx context.Context, cancel context.CancelFunc, envKey string, opts *Options) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		SelfMonitor(ctx, envKey, opts)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Errorf("SelfMonitor did not shut down during test cleanup")
+		}
+	})
+}
+
+func TestWatchdogForcesRestartOnMissedDeadline(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "pids")
+	os.Setenv(testScenarioEnv, "hang")
+	os.Setenv(testPidFileEnv, pidFile)
+	defer os.Unsetenv(testScenarioEnv)
+	defer os.Unsetenv(testPidFileEnv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second)
+	runSelfMonitor(t, ctx, cancel, testEnvKey, &Options{
+		WatchdogInterval:  30 * time.Millisecond,
+		MinBackoffTimeout: 10 * time.Millisecond,
+		MaxBackoffTimeout: 10 * time.Millisecond,
+		ShutdownTimeout:   time.Second,
+	})
+
+	// The "hang" child reports ready but never pings the watchdog, so the
+	// monitor must force-restart it on its own, spawning a second instance
+	// that appends its own pid to pidFile.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		data, _ := os.ReadFile(pidFile)
+		if bytes.Count(data, []byte("\n")) >= 2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("watchdog never forced a restart of the hung child; pidFile contents: %q", data)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestGracefulRestartRetiresOldChildWithoutLeakingItsReceiver(t *testing.T) {
+	runtimeDir := t.TempDir()
+	os.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+	os.Setenv(testScenarioEnv, "ready")
+	defer os.Unsetenv("XDG_RUNTIME_DIR")
+	defer os.Unsetenv(testScenarioEnv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	runSelfMonitor(t, ctx, cancel, testEnvKey, &Options{
+		MinBackoffTimeout: 10 * time.Millisecond,
+		MaxBackoffTimeout: 10 * time.Millisecond,
+		ShutdownTimeout:   time.Second,
+	})
+
+	// Every startChild creates its initstatus receiver's unix socket under
+	// XDG_RUNTIME_DIR, and removes it again once the receiver is closed.
+	// Polling for a settled count of 1 after each graceful restart (rather
+	// than an instant snapshot) tolerates the brief window where both the
+	// outgoing and incoming child's sockets legitimately coexist.
+	waitForSocketCount := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			matches, _ := filepath.Glob(filepath.Join(runtimeDir, "isock*", "s"))
+			if len(matches) == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %d live initstatus socket(s), have %d: %v", want, len(matches), matches)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	waitForSocketCount(1) // The first child is up and reporting over its socket.
+
+	for i := 0; i < 3; i++ {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("Kill(SIGHUP): %v", err)
+		}
+		// A replacement child's socket briefly brings the count to two;
+		// the retired child's socket must then be cleaned up promptly
+		// instead of accumulating until SelfMonitor itself returns.
+		waitForSocketCount(1)
+	}
+}
+
+func TestSubreaperSelfMonitorReturnsOnContextCancel(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("subreaper mode is Linux-only")
+	}
+
+	os.Setenv(testScenarioEnv, "ready")
+	defer os.Unsetenv(testScenarioEnv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// Enabling Subreaper starts reaper.Reap's wait4(-1) sweep for the
+	// duration of SelfMonitor, concurrently with SelfMonitor's own
+	// cmd.Wait on the very same managed child; reaper.Track is what keeps
+	// them from racing for its exit status. This test checks that, with
+	// the sweep running, SelfMonitor still shuts its child down and returns
+	// the context's cancellation cause once ctx is cancelled. A lost race
+	// would make cmd.Wait return an error rather than hang, so SelfMonitor
+	// returns either way and this test does not detect one.
+	errc := make(chan error, 1)
+	go func() {
+		errc <- SelfMonitor(ctx, testEnvKey, &Options{
+			Subreaper:         true,
+			MinBackoffTimeout: 10 * time.Millisecond,
+			MaxBackoffTimeout: 10 * time.Millisecond,
+			ShutdownTimeout:   time.Second,
+		})
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("SelfMonitor returned nil, want the context's cancellation cause")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("SelfMonitor did not return after its context was cancelled with Subreaper enabled")
+	}
+}